@@ -29,6 +29,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -132,6 +133,11 @@ type Member struct {
 	URI   string
 	state MemberState
 	Info  string
+	// LeaseExpiry is the time at which this member's heartbeat lease
+	// expires if not renewed via Membership.RenewLease().
+	LeaseExpiry time.Time
+	// LeaseDuration is the TTL applied each time the lease is renewed.
+	LeaseDuration time.Duration
 }
 
 // MarshalJSON marshals system.Member to JSON.
@@ -278,11 +284,61 @@ func (smr MemberResults) HasErrors() bool {
 	return false
 }
 
+// membershipDB is the storage interface required by Membership. It is
+// satisfied by the single-process *Database as well as the Raft-replicated
+// *ReplicatedDatabase, allowing Membership to be agnostic of whether its
+// mutations are being applied locally or via consensus across a quorum of
+// control-plane replicas.
+type membershipDB interface {
+	FindMemberByUUID(uuid uuid.UUID) (*Member, error)
+	FindMemberByRank(rank Rank) (*Member, error)
+	AddMember(m *Member) error
+	UpdateMember(m *Member) error
+	RemoveMember(m *Member) error
+	MemberCount() int
+	MemberRanks() []Rank
+	AllMembers() Members
+	CurMapVersion() uint32
+}
+
+// DefaultLeaseScanInterval is how often the lease monitor goroutine scans
+// membership for expired leases, unless overridden via NewMembership.
+const DefaultLeaseScanInterval = 1 * time.Second
+
+// MemberEvent describes a state transition applied to a member.
+type MemberEvent struct {
+	Rank       Rank
+	UUID       uuid.UUID
+	Addr       string
+	OldState   MemberState
+	NewState   MemberState
+	MapVersion uint32
+	Timestamp  time.Time
+}
+
 // Membership tracks details of system members.
 type Membership struct {
 	sync.RWMutex
 	log logging.Logger
-	db  *Database
+	db  membershipDB
+
+	// leaseTTL is the lease duration granted to a member on Join; zero
+	// means Join grants no lease. Members given a lease by RenewLease are
+	// still subject to lease-driven transitions.
+	leaseTTL time.Duration
+	// evictionGrace is how long after its lease expired a
+	// MemberStateUnresponsive member is auto-evicted.
+	evictionGrace     time.Duration
+	leaseScanInterval time.Duration
+	stopLeaseMon      chan struct{}
+	stopOnce          sync.Once
+
+	subsMu    sync.Mutex
+	nextSubID uint64
+	subs      map[uint64]*subscription
+
+	histMu  sync.Mutex
+	history []MemberEvent
 }
 
 func (m *Membership) addMember(member *Member) error {
@@ -292,7 +348,12 @@ func (m *Membership) addMember(member *Member) error {
 	}
 	m.log.Debugf("adding system member: %s", member)
 
-	return m.db.AddMember(member)
+	if err := m.db.AddMember(member); err != nil {
+		return err
+	}
+	m.notify(member, MemberStateUnknown, member.State())
+
+	return nil
 }
 
 func (m *Membership) updateMember(member *Member) error {
@@ -302,7 +363,12 @@ func (m *Membership) updateMember(member *Member) error {
 		return err
 	}
 
-	return m.db.AddMember(member)
+	if err := m.db.AddMember(member); err != nil {
+		return err
+	}
+	m.notify(member, old.State(), member.State())
+
+	return nil
 }
 
 // Add adds member to membership, returns member count.
@@ -339,6 +405,15 @@ func (m *Membership) Join(newMember *Member) (res *MemberJoinResult, err error)
 	}()
 
 	newMember.state = MemberStateJoined
+	if m.leaseTTL > 0 {
+		// A successful Join is the start of lease supervision for this
+		// member: grant it a fresh lease so the background monitor can
+		// later detect a missing renewal and demote it, rather than
+		// requiring a separate call that nothing in this package ever
+		// makes.
+		newMember.LeaseDuration = m.leaseTTL
+		newMember.LeaseExpiry = time.Now().Add(m.leaseTTL)
+	}
 	r := new(MemberJoinResult)
 	curMember, err := m.db.FindMemberByUUID(newMember.UUID)
 	if err == nil {
@@ -347,6 +422,7 @@ func (m *Membership) Join(newMember *Member) (res *MemberJoinResult, err error)
 			return nil, err
 		}
 		r.MapVersion = m.db.CurMapVersion()
+		m.notify(newMember, r.PrevState, newMember.State())
 
 		return r, nil
 	}
@@ -356,6 +432,7 @@ func (m *Membership) Join(newMember *Member) (res *MemberJoinResult, err error)
 		return nil, err
 	}
 	r.MapVersion = m.db.CurMapVersion()
+	m.notify(newMember, MemberStateUnknown, newMember.State())
 
 	return r, nil
 }
@@ -387,7 +464,9 @@ func (m *Membership) Remove(rank Rank) {
 	}
 	if err := m.db.RemoveMember(member); err != nil {
 		m.log.Errorf("remove %d failed: %s", rank, err)
+		return
 	}
+	m.notify(member, member.State(), MemberStateUnknown)
 }
 
 // Get retrieves member reference from membership based on Rank.
@@ -518,18 +597,182 @@ func (m *Membership) UpdateMemberStates(results MemberResults, ignoreErrored boo
 		if member.State().isTransitionIllegal(result.State) {
 			continue
 		}
-		member.state = result.State
-		member.Info = result.Msg
 
-		if err := m.db.UpdateMember(member); err != nil {
+		// Apply the transition to a copy and only let it replace the
+		// committed member once UpdateMember succeeds; db.UpdateMember
+		// can fail (e.g. this node is not the Raft leader, or the
+		// apply times out) and the in-memory Member must not appear
+		// to have transitioned if the quorum never agreed to it.
+		old := member.State()
+		updated := *member
+		updated.state = result.State
+		updated.Info = result.Msg
+
+		// A member leaving MemberStateJoined by any path other than
+		// the lease monitor itself (e.g. a clean prep-shutdown) is no
+		// longer under lease supervision; clear the lease so it can't
+		// later be picked up as "expired" by scanLeases and demoted.
+		if old == MemberStateJoined && updated.state != MemberStateJoined {
+			updated.LeaseExpiry = time.Time{}
+			updated.LeaseDuration = 0
+		}
+
+		if err := m.db.UpdateMember(&updated); err != nil {
 			return err
 		}
+		m.notify(&updated, old, updated.State())
 	}
 
 	return nil
 }
 
 // NewMembership returns a reference to a new DAOS system membership.
-func NewMembership(log logging.Logger, db *Database) *Membership {
-	return &Membership{db: db, log: log}
+//
+// leaseTTL is the lease duration granted to a member when it joins; pass
+// zero for Join to grant no lease (the lease monitor still acts on leases
+// set by RenewLease). evictionGrace is how long after its lease expired a
+// MemberStateUnresponsive member is auto-evicted. leaseScanInterval controls how often expired leases are
+// scanned for; pass zero to use DefaultLeaseScanInterval.
+func NewMembership(log logging.Logger, db membershipDB, leaseTTL, evictionGrace, leaseScanInterval time.Duration) *Membership {
+	if leaseScanInterval == 0 {
+		leaseScanInterval = DefaultLeaseScanInterval
+	}
+
+	m := &Membership{
+		db:                db,
+		log:               log,
+		leaseTTL:          leaseTTL,
+		evictionGrace:     evictionGrace,
+		leaseScanInterval: leaseScanInterval,
+		stopLeaseMon:      make(chan struct{}),
+		subs:              make(map[uint64]*subscription),
+	}
+
+	go m.monitorLeases()
+
+	return m
+}
+
+// RenewLease renews rank's heartbeat lease for the given ttl. It does not
+// change the member's state: a member already MemberStateUnresponsive stays
+// so, and is no longer escalated to Evicted while its lease is current. It
+// should be called whenever a member successfully joins
+// or responds to a ping.
+func (m *Membership) RenewLease(rank Rank, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+
+	member, err := m.db.FindMemberByRank(rank)
+	if err != nil {
+		return err
+	}
+
+	// Mutate a copy so a failed replication (not leader, apply timeout)
+	// can't leave the shared Member looking renewed when it never
+	// actually committed.
+	updated := *member
+	updated.LeaseDuration = ttl
+	updated.LeaseExpiry = time.Now().Add(ttl)
+
+	return m.db.UpdateMember(&updated)
+}
+
+// monitorLeases periodically scans membership for expired leases, demoting
+// MemberStateJoined members whose lease has expired to
+// MemberStateUnresponsive, and MemberStateUnresponsive members whose lease
+// expired more than evictionGrace ago to MemberStateEvicted.
+func (m *Membership) monitorLeases() {
+	ticker := time.NewTicker(m.leaseScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.scanLeases()
+		case <-m.stopLeaseMon:
+			return
+		}
+	}
+}
+
+// scanLeases finds members with expired leases and hands each off to
+// applyLeaseExpiry. It only holds m's lock long enough to take a
+// consistent snapshot of membership: the actual state transitions are
+// applied concurrently and without m's lock held, so one slow db.UpdateMember
+// (a real Raft round-trip for a ReplicatedDatabase, up to applyTimeout) can't
+// serialize behind another or block unrelated Membership calls for the
+// duration of the scan.
+func (m *Membership) scanLeases() {
+	m.RLock()
+	now := time.Now()
+	var expired []*Member
+	for _, member := range m.db.AllMembers() {
+		if member.LeaseExpiry.IsZero() || now.Before(member.LeaseExpiry) {
+			continue
+		}
+		expired = append(expired, member)
+	}
+	m.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, member := range expired {
+		wg.Add(1)
+		go func(member *Member) {
+			defer wg.Done()
+			m.applyLeaseExpiry(member)
+		}(member)
+	}
+	wg.Wait()
+}
+
+// applyLeaseExpiry demotes or evicts a single member whose lease has
+// expired, as found by scanLeases.
+func (m *Membership) applyLeaseExpiry(member *Member) {
+	now := time.Now()
+
+	// Only members actively under lease supervision are subject to
+	// auto-transition: MemberStateJoined may be demoted to
+	// Unresponsive, and MemberStateUnresponsive may be escalated
+	// to Evicted. isTransitionIllegal alone isn't a safe gate here
+	// since it permits transitions into Unresponsive from states
+	// (e.g. Stopped, Ready) that were never meant to be driven by
+	// lease expiry.
+	var next MemberState
+	switch member.State() {
+	case MemberStateJoined:
+		next = MemberStateUnresponsive
+	case MemberStateUnresponsive:
+		if now.Before(member.LeaseExpiry.Add(m.evictionGrace)) {
+			return
+		}
+		next = MemberStateEvicted
+	default:
+		return
+	}
+
+	if member.State().isTransitionIllegal(next) {
+		return
+	}
+
+	// Mutate a copy so a failed replication can't leave the shared
+	// Member looking transitioned when the quorum never committed
+	// it.
+	old := member.State()
+	updated := *member
+	updated.state = next
+	if err := m.db.UpdateMember(&updated); err != nil {
+		m.log.Errorf("lease monitor failed to update rank %d: %s", member.Rank, err)
+		return
+	}
+
+	m.notify(&updated, old, next)
+}
+
+// Stop terminates the background lease monitor goroutine. It should be
+// called when the Membership is no longer needed. It is safe to call more
+// than once.
+func (m *Membership) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopLeaseMon)
+	})
 }
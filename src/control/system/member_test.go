@@ -0,0 +1,157 @@
+//
+// (C) Copyright 2019-2020 Intel Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// GOVERNMENT LICENSE RIGHTS-OPEN SOURCE SOFTWARE
+// The Government's rights to use, modify, reproduce, release, perform, display,
+// or disclose this software are subject to the terms of the Apache License as
+// provided in Contract No. 8F-30005.
+// Any reproduction of computer software, computer software documentation, or
+// portions thereof marked with this legend must also reproduce the markings.
+//
+
+package system
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daos-stack/daos/src/control/logging"
+)
+
+// TestMembership_JoinedMemberAutoEvictedOnLeaseExpiry drives a member
+// through Join, a missed lease renewal, and the full
+// Joined->Unresponsive->Evicted sequence, proving that Join's grant of an
+// initial lease is enough on its own to make the chunk0-2 auto-eviction
+// feature reachable without any other caller renewing it.
+func TestMembership_JoinedMemberAutoEvictedOnLeaseExpiry(t *testing.T) {
+	leaseTTL := 20 * time.Millisecond
+	evictionGrace := 20 * time.Millisecond
+	scanInterval := 5 * time.Millisecond
+
+	ms := NewMembership(logging.NewStdLogger(os.Stdout), newFakeMemberDB(),
+		leaseTTL, evictionGrace, scanInterval)
+	defer ms.Stop()
+
+	member := newTestMember(t, 1)
+	if _, err := ms.Join(member); err != nil {
+		t.Fatalf("Join failed: %s", err)
+	}
+
+	waitForMemberState(t, ms, member.Rank, MemberStateUnresponsive, time.Second)
+	waitForMemberState(t, ms, member.Rank, MemberStateEvicted, time.Second)
+}
+
+// waitForMemberState polls until member's rank reaches want, failing the
+// test if it doesn't happen within timeout.
+func waitForMemberState(t *testing.T, ms *Membership, rank Rank, want MemberState, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		got, err := ms.Get(rank)
+		if err != nil {
+			t.Fatalf("Get failed: %s", err)
+		}
+		if got.State() == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("rank %d did not reach state %s before deadline", rank, want)
+}
+
+// slowUpdateDB wraps a membershipDB and makes UpdateMember block for delay,
+// tracking the peak number of concurrent UpdateMember calls in flight.
+type slowUpdateDB struct {
+	membershipDB
+	delay        time.Duration
+	inFlight     int32
+	peakInFlight int32
+}
+
+func (s *slowUpdateDB) UpdateMember(m *Member) error {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	for {
+		peak := atomic.LoadInt32(&s.peakInFlight)
+		if n <= peak || atomic.CompareAndSwapInt32(&s.peakInFlight, peak, n) {
+			break
+		}
+	}
+
+	time.Sleep(s.delay)
+
+	return s.membershipDB.UpdateMember(m)
+}
+
+// TestMembership_ScanLeasesDoesNotSerializeSlowApplies expires several
+// members' leases at once against a membershipDB whose UpdateMember is
+// slow, and checks both that the applies overlap (the lock isn't held
+// across them) and that an unrelated Membership.Get isn't blocked for the
+// duration of the scan.
+func TestMembership_ScanLeasesDoesNotSerializeSlowApplies(t *testing.T) {
+	const numExpired = 4
+	const applyDelay = 100 * time.Millisecond
+
+	fake := newFakeMemberDB()
+	slow := &slowUpdateDB{membershipDB: fake, delay: applyDelay}
+
+	ms := NewMembership(logging.NewStdLogger(os.Stdout), slow, 0, time.Hour, time.Hour)
+	defer ms.Stop()
+
+	for i := Rank(1); i <= numExpired; i++ {
+		member := newTestMember(t, i)
+		if err := fake.AddMember(member); err != nil {
+			t.Fatalf("failed to seed member: %s", err)
+		}
+		member.LeaseDuration = time.Millisecond
+		member.LeaseExpiry = time.Now().Add(-time.Millisecond) // already expired
+		if err := fake.UpdateMember(member); err != nil {
+			t.Fatalf("failed to seed expired lease: %s", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ms.scanLeases()
+	}()
+
+	// scanLeases must release m's lock around the slow applies, so Get
+	// should complete quickly instead of blocking behind the scan.
+	time.Sleep(applyDelay / 2)
+	getDone := make(chan struct{})
+	go func() {
+		ms.Get(1)
+		close(getDone)
+	}()
+	select {
+	case <-getDone:
+	case <-time.After(applyDelay / 2):
+		t.Fatal("Get blocked behind scanLeases holding the membership lock during a slow apply")
+	}
+
+	wg.Wait()
+
+	if peak := atomic.LoadInt32(&slow.peakInFlight); peak < 2 {
+		t.Fatalf("expected expired-lease applies to overlap, but peak concurrency was %d", peak)
+	}
+}
@@ -0,0 +1,218 @@
+//
+// (C) Copyright 2019-2020 Intel Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// GOVERNMENT LICENSE RIGHTS-OPEN SOURCE SOFTWARE
+// The Government's rights to use, modify, reproduce, release, perform, display,
+// or disclose this software are subject to the terms of the Apache License as
+// provided in Contract No. 8F-30005.
+// Any reproduction of computer software, computer software documentation, or
+// portions thereof marked with this legend must also reproduce the markings.
+//
+
+package system
+
+import (
+	"net"
+	"path"
+	"time"
+)
+
+// defaultSubscriberBuffer bounds how many undelivered events a subscriber
+// may accumulate before new events are dropped.
+const defaultSubscriberBuffer = 32
+
+// defaultEventHistory bounds how many past events are retained to service
+// SubscriberFilter.ReplayFromVersion.
+const defaultEventHistory = 256
+
+// CancelFunc unregisters a subscription created by Membership.Subscribe.
+// It is idempotent; calling it more than once has no effect.
+type CancelFunc func()
+
+// SubscriberFilter scopes the set of MemberEvents delivered to a
+// subscription. Zero-valued fields place no restriction on that dimension.
+type SubscriberFilter struct {
+	// Ranks restricts delivery to events for the listed ranks.
+	Ranks []Rank
+	// HostGlobs restricts delivery to events whose member host address
+	// matches one of the given path.Match-style globs (e.g. "10.0.0.*").
+	HostGlobs []string
+	// OnlyTransitionTo restricts delivery to events whose NewState is one
+	// of the listed states (e.g. MemberStateEvicted).
+	OnlyTransitionTo []MemberState
+	// ReplayFromVersion, if non-zero, causes Subscribe to first deliver
+	// any buffered events with MapVersion greater than this value,
+	// before the subscription begins receiving live events.
+	ReplayFromVersion uint32
+}
+
+func (f *SubscriberFilter) matches(ev *MemberEvent) bool {
+	if len(f.Ranks) != 0 && !ev.Rank.InList(f.Ranks) {
+		return false
+	}
+
+	if len(f.HostGlobs) != 0 {
+		host := ev.Addr
+		if h, _, err := net.SplitHostPort(ev.Addr); err == nil {
+			host = h
+		}
+
+		matched := false
+		for _, glob := range f.HostGlobs {
+			if ok, _ := path.Match(glob, host); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(f.OnlyTransitionTo) != 0 {
+		matched := false
+		for _, s := range f.OnlyTransitionTo {
+			if ev.NewState == s {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// subscription is the internal bookkeeping for a single Subscribe call.
+type subscription struct {
+	filter  SubscriberFilter
+	ch      chan MemberEvent
+	dropped uint64
+}
+
+// Subscribe registers interest in membership change events matching filter,
+// returning a channel on which matching events are delivered and a
+// CancelFunc to unregister. The channel is buffered; if a subscriber falls
+// behind, further events are dropped (logged, and counted) rather than
+// blocking the membership write lock.
+func (m *Membership) Subscribe(filter SubscriberFilter) (<-chan MemberEvent, CancelFunc) {
+	sub := &subscription{
+		filter: filter,
+		ch:     make(chan MemberEvent, defaultSubscriberBuffer),
+	}
+
+	m.subsMu.Lock()
+	id := m.nextSubID
+	m.nextSubID++
+	m.subs[id] = sub
+
+	// Replay while still holding subsMu, using the same non-blocking
+	// deliver() as live events, so a backlog larger than the subscriber
+	// buffer is dropped (and counted) instead of deadlocking Subscribe.
+	if filter.ReplayFromVersion > 0 {
+		for _, ev := range m.replayEvents(filter.ReplayFromVersion) {
+			if filter.matches(&ev) {
+				m.deliver(sub, ev)
+			}
+		}
+	}
+	m.subsMu.Unlock()
+
+	cancel := func() {
+		m.subsMu.Lock()
+		defer m.subsMu.Unlock()
+
+		if _, exists := m.subs[id]; !exists {
+			return
+		}
+		delete(m.subs, id)
+		close(sub.ch)
+	}
+
+	return sub.ch, cancel
+}
+
+// replayEvents returns a copy of all recorded events with a MapVersion
+// greater than since, in the order they were recorded.
+func (m *Membership) replayEvents(since uint32) []MemberEvent {
+	m.histMu.Lock()
+	defer m.histMu.Unlock()
+
+	var out []MemberEvent
+	for _, ev := range m.history {
+		if ev.MapVersion > since {
+			out = append(out, ev)
+		}
+	}
+
+	return out
+}
+
+// recordEvent appends ev to the bounded event history used to service
+// replay requests.
+func (m *Membership) recordEvent(ev MemberEvent) {
+	m.histMu.Lock()
+	defer m.histMu.Unlock()
+
+	m.history = append(m.history, ev)
+	if len(m.history) > defaultEventHistory {
+		m.history = m.history[len(m.history)-defaultEventHistory:]
+	}
+}
+
+// notify builds a MemberEvent describing member's transition from oldState
+// to newState, records it for replay, and delivers it to
+// every subscription whose filter matches.
+func (m *Membership) notify(member *Member, oldState, newState MemberState) {
+	ev := MemberEvent{
+		Rank:       member.Rank,
+		UUID:       member.UUID,
+		Addr:       member.Addr.String(),
+		OldState:   oldState,
+		NewState:   newState,
+		MapVersion: m.db.CurMapVersion(),
+		Timestamp:  time.Now(),
+	}
+
+	m.recordEvent(ev)
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+
+	for _, sub := range m.subs {
+		if !sub.filter.matches(&ev) {
+			continue
+		}
+
+		m.deliver(sub, ev)
+	}
+}
+
+// deliver attempts a non-blocking send of ev to sub, dropping (and
+// counting + logging) it rather than blocking the caller if sub's buffer
+// is full. Used for both live events and replayed history, since a
+// reconnecting subscriber's backlog can just as easily exceed its buffer
+// as a burst of live events can.
+func (m *Membership) deliver(sub *subscription, ev MemberEvent) {
+	select {
+	case sub.ch <- ev:
+	default:
+		sub.dropped++
+		m.log.Errorf("dropped membership event for rank %d (subscriber buffer full, %d dropped total)",
+			ev.Rank, sub.dropped)
+	}
+}
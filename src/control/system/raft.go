@@ -0,0 +1,364 @@
+//
+// (C) Copyright 2019-2020 Intel Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// GOVERNMENT LICENSE RIGHTS-OPEN SOURCE SOFTWARE
+// The Government's rights to use, modify, reproduce, release, perform, display,
+// or disclose this software are subject to the terms of the Apache License as
+// provided in Contract No. 8F-30005.
+// Any reproduction of computer software, computer software documentation, or
+// portions thereof marked with this legend must also reproduce the markings.
+//
+
+package system
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+
+	"github.com/daos-stack/daos/src/control/logging"
+)
+
+// defaultApplyTimeout bounds how long a mutating Membership operation will
+// wait for its corresponding Raft log entry to be committed before giving up.
+const defaultApplyTimeout = 10 * time.Second
+
+// raftOpCode identifies the kind of membership mutation encoded in a Raft
+// log entry.
+type raftOpCode uint8
+
+const (
+	raftOpAddMember raftOpCode = iota
+	raftOpUpdateMember
+	raftOpRemoveMember
+)
+
+// raftUpdate is the payload of a Raft log entry applied to the membership
+// FSM. Op names the mutation and Member is the member it applies to; both
+// are set for every op.
+type raftUpdate struct {
+	Op     raftOpCode
+	Member *Member
+}
+
+// ReplicatedDatabase wraps a membershipDB (normally a *Database) with a
+// Raft consensus layer so that AddMember, UpdateMember and RemoveMember are
+// only acknowledged to the caller once they have been committed to a
+// quorum of control-plane replicas. It implements membershipDB and
+// raft.FSM.
+type ReplicatedDatabase struct {
+	sync.RWMutex
+	log          logging.Logger
+	db           membershipDB
+	raft         *raft.Raft
+	applyTimeout time.Duration
+
+	// onLeader is invoked with the just-applied map version whenever this
+	// replica is elected leader, so that leader-only work left behind by
+	// the previous leader (e.g. rank assignment) can be resumed.
+	onLeader func(mapVersion uint32)
+}
+
+// NewReplicatedDatabase wraps db with a Raft consensus layer. The returned
+// ReplicatedDatabase must be used as the raft.FSM passed to raft.NewRaft,
+// and the resulting *raft.Raft must then be handed back via SetRaft before
+// any other method is called; ReplicatedDatabase can't take the *raft.Raft
+// as a constructor argument because raft.NewRaft itself needs the FSM (i.e.
+// this ReplicatedDatabase) to already exist.
+func NewReplicatedDatabase(log logging.Logger, db membershipDB) *ReplicatedDatabase {
+	return &ReplicatedDatabase{
+		log:          log,
+		db:           db,
+		applyTimeout: defaultApplyTimeout,
+	}
+}
+
+// SetRaft associates r, the *raft.Raft instance constructed with this
+// ReplicatedDatabase as its FSM, so that AddMember/UpdateMember/RemoveMember
+// and leadership tracking can submit to and query it. It must be called
+// once, before any other ReplicatedDatabase method.
+func (rd *ReplicatedDatabase) SetRaft(r *raft.Raft) {
+	rd.Lock()
+	defer rd.Unlock()
+
+	rd.raft = r
+}
+
+// OnLeader registers a callback to be invoked with the current map version
+// whenever this replica becomes the Raft leader. Only one callback may be
+// registered at a time; a later call replaces any previous callback.
+func (rd *ReplicatedDatabase) OnLeader(fn func(mapVersion uint32)) {
+	rd.Lock()
+	defer rd.Unlock()
+
+	rd.onLeader = fn
+}
+
+// WatchLeadership starts a goroutine that invokes the registered OnLeader
+// callback whenever this replica transitions into the leader role. The
+// goroutine exits when stop is closed.
+func (rd *ReplicatedDatabase) WatchLeadership(stop <-chan struct{}) {
+	rd.RLock()
+	r := rd.raft
+	rd.RUnlock()
+
+	go func() {
+		for {
+			select {
+			case isLeader, ok := <-r.LeaderCh():
+				if !ok {
+					return
+				}
+				if !isLeader {
+					continue
+				}
+				rd.RLock()
+				onLeader := rd.onLeader
+				rd.RUnlock()
+				if onLeader != nil {
+					onLeader(rd.CurMapVersion())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// apply serializes update and submits it to the Raft log, blocking until it
+// has either been committed and applied by the FSM, or failed.
+func (rd *ReplicatedDatabase) apply(update *raftUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal raft update")
+	}
+
+	rd.RLock()
+	r := rd.raft
+	rd.RUnlock()
+
+	future := r.Apply(data, rd.applyTimeout)
+	if err := future.Error(); err != nil {
+		return errors.Wrap(err, "raft apply failed")
+	}
+
+	if respErr, ok := future.Response().(error); ok && respErr != nil {
+		return respErr
+	}
+
+	return nil
+}
+
+// AddMember replicates the addition of a new member via Raft before
+// returning.
+func (rd *ReplicatedDatabase) AddMember(m *Member) error {
+	return rd.apply(&raftUpdate{Op: raftOpAddMember, Member: m})
+}
+
+// UpdateMember replicates an update to an existing member via Raft before
+// returning.
+func (rd *ReplicatedDatabase) UpdateMember(m *Member) error {
+	return rd.apply(&raftUpdate{Op: raftOpUpdateMember, Member: m})
+}
+
+// RemoveMember replicates the removal of a member via Raft before
+// returning.
+func (rd *ReplicatedDatabase) RemoveMember(m *Member) error {
+	return rd.apply(&raftUpdate{Op: raftOpRemoveMember, Member: m})
+}
+
+// linearizableRead issues a Raft barrier and blocks until every preceding
+// log entry has been applied to the local FSM, so that a subsequent local
+// read observes every mutation committed before the call was made. The
+// barrier only succeeds on the leader; on a follower it returns an error.
+func (rd *ReplicatedDatabase) linearizableRead() error {
+	rd.RLock()
+	r := rd.raft
+	rd.RUnlock()
+
+	return r.Barrier(rd.applyTimeout).Error()
+}
+
+// FindMemberByUUID services the read from locally applied state.
+//
+// rd.db is also written to by Apply/Restore, invoked by Raft's own FSM
+// goroutine outside of any caller's lock, so every access (read or write)
+// must go through rd's RWMutex.
+func (rd *ReplicatedDatabase) FindMemberByUUID(id uuid.UUID) (*Member, error) {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.FindMemberByUUID(id)
+}
+
+// FindMemberByRank services the read from locally applied state.
+func (rd *ReplicatedDatabase) FindMemberByRank(rank Rank) (*Member, error) {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.FindMemberByRank(rank)
+}
+
+// MemberCount services the read from locally applied state.
+func (rd *ReplicatedDatabase) MemberCount() int {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.MemberCount()
+}
+
+// MemberRanks services the read from locally applied state.
+func (rd *ReplicatedDatabase) MemberRanks() []Rank {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.MemberRanks()
+}
+
+// AllMembers services the read from locally applied state.
+func (rd *ReplicatedDatabase) AllMembers() Members {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.AllMembers()
+}
+
+// CurMapVersion services the read from locally applied state.
+func (rd *ReplicatedDatabase) CurMapVersion() uint32 {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return rd.db.CurMapVersion()
+}
+
+// Apply implements raft.FSM, applying a committed log entry to the
+// underlying *Database. The returned value is surfaced to the waiting
+// apply() call via future.Response().
+//
+// This runs on Raft's internal FSM goroutine, not under the caller's lock,
+// so rd.db must be guarded here just as it is for reads.
+func (rd *ReplicatedDatabase) Apply(log *raft.Log) interface{} {
+	update := new(raftUpdate)
+	if err := json.Unmarshal(log.Data, update); err != nil {
+		return errors.Wrap(err, "failed to unmarshal raft update")
+	}
+
+	rd.Lock()
+	defer rd.Unlock()
+
+	switch update.Op {
+	case raftOpAddMember:
+		return rd.db.AddMember(update.Member)
+	case raftOpUpdateMember:
+		return rd.db.UpdateMember(update.Member)
+	case raftOpRemoveMember:
+		return rd.db.RemoveMember(update.Member)
+	default:
+		return errors.Errorf("unknown raft op %d", update.Op)
+	}
+}
+
+// membershipSnapshot is a point-in-time capture of every member, taken for
+// the purpose of bootstrapping new or lagging Raft followers.
+type membershipSnapshot struct {
+	Members Members
+}
+
+// Persist writes the snapshot out, reusing Member's existing JSON
+// marshaling so that Restore can read it back with UnmarshalJSON.
+func (s *membershipSnapshot) Persist(sink raft.SnapshotSink) error {
+	data, err := json.Marshal(s.Members)
+	if err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "failed to marshal membership snapshot")
+	}
+
+	if _, err := sink.Write(data); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "failed to write membership snapshot")
+	}
+
+	return sink.Close()
+}
+
+// Release is a no-op; the snapshot holds no resources that outlive Persist.
+func (s *membershipSnapshot) Release() {}
+
+// Snapshot implements raft.FSM, capturing the full set of members so that a
+// new follower can catch up without replaying the entire log.
+func (rd *ReplicatedDatabase) Snapshot() (raft.FSMSnapshot, error) {
+	rd.RLock()
+	defer rd.RUnlock()
+
+	return &membershipSnapshot{Members: rd.db.AllMembers()}, nil
+}
+
+// Restore implements raft.FSM, replacing the local member set with the
+// contents of a snapshot taken on another replica.
+func (rd *ReplicatedDatabase) Restore(snap io.ReadCloser) error {
+	defer snap.Close()
+
+	data, err := io.ReadAll(snap)
+	if err != nil {
+		return errors.Wrap(err, "failed to read membership snapshot")
+	}
+
+	var members Members
+	if err := json.Unmarshal(data, &members); err != nil {
+		return errors.Wrap(err, "failed to unmarshal membership snapshot")
+	}
+
+	rd.Lock()
+	defer rd.Unlock()
+
+	// A snapshot is a full point-in-time view of membership, not a diff,
+	// and Raft calls Restore on followers that already hold state (that's
+	// the normal lagging-follower case, not just an empty store on first
+	// join). So local state must end up identical to the snapshot: drop
+	// anything not present in it, and update rather than re-add anything
+	// that already exists locally.
+	incoming := make(map[uuid.UUID]*Member, len(members))
+	for _, m := range members {
+		incoming[m.UUID] = m
+	}
+
+	for _, local := range rd.db.AllMembers() {
+		if _, keep := incoming[local.UUID]; keep {
+			continue
+		}
+		if err := rd.db.RemoveMember(local); err != nil {
+			return errors.Wrapf(err, "failed to remove stale member %s during restore", local)
+		}
+	}
+
+	for _, m := range members {
+		if _, err := rd.db.FindMemberByUUID(m.UUID); err == nil {
+			if err := rd.db.UpdateMember(m); err != nil {
+				return errors.Wrapf(err, "failed to restore member %s", m)
+			}
+			continue
+		}
+		if err := rd.db.AddMember(m); err != nil {
+			return errors.Wrapf(err, "failed to restore member %s", m)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,401 @@
+//
+// (C) Copyright 2019-2020 Intel Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// GOVERNMENT LICENSE RIGHTS-OPEN SOURCE SOFTWARE
+// The Government's rights to use, modify, reproduce, release, perform, display,
+// or disclose this software are subject to the terms of the Apache License as
+// provided in Contract No. 8F-30005.
+// Any reproduction of computer software, computer software documentation, or
+// portions thereof marked with this legend must also reproduce the markings.
+//
+
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+
+	"github.com/daos-stack/daos/src/control/logging"
+)
+
+// fakeMemberDB is a minimal in-memory membershipDB used to exercise
+// ReplicatedDatabase without depending on the real, disk-backed *Database.
+type fakeMemberDB struct {
+	mu      sync.Mutex
+	members map[uuid.UUID]*Member
+	version uint32
+}
+
+func newFakeMemberDB() *fakeMemberDB {
+	return &fakeMemberDB{members: make(map[uuid.UUID]*Member)}
+}
+
+func (f *fakeMemberDB) FindMemberByUUID(id uuid.UUID) (*Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m, found := f.members[id]
+	if !found {
+		return nil, errors.Errorf("member %s not found", id)
+	}
+	return m, nil
+}
+
+func (f *fakeMemberDB) FindMemberByRank(rank Rank) (*Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.members {
+		if m.Rank == rank {
+			return m, nil
+		}
+	}
+	return nil, errors.Errorf("rank %d not found", rank)
+}
+
+func (f *fakeMemberDB) AddMember(m *Member) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.members[m.UUID] = m
+	f.version++
+	return nil
+}
+
+func (f *fakeMemberDB) UpdateMember(m *Member) error {
+	return f.AddMember(m)
+}
+
+func (f *fakeMemberDB) RemoveMember(m *Member) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.members, m.UUID)
+	f.version++
+	return nil
+}
+
+func (f *fakeMemberDB) MemberCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.members)
+}
+
+func (f *fakeMemberDB) MemberRanks() []Rank {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ranks := make([]Rank, 0, len(f.members))
+	for _, m := range f.members {
+		ranks = append(ranks, m.Rank)
+	}
+	return ranks
+}
+
+func (f *fakeMemberDB) AllMembers() Members {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ms := make(Members, 0, len(f.members))
+	for _, m := range f.members {
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+func (f *fakeMemberDB) CurMapVersion() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.version
+}
+
+// testRaftNode bundles a ReplicatedDatabase with the raft.Raft instance it
+// backs, so a test can address either layer.
+type testRaftNode struct {
+	rdb  *ReplicatedDatabase
+	raft *raft.Raft
+}
+
+// newTestRaftCluster brings up an n-node Raft cluster wired together with
+// in-memory transports, each backed by its own ReplicatedDatabase over a
+// fakeMemberDB, and blocks until a leader is elected.
+func newTestRaftCluster(t *testing.T, n int) []*testRaftNode {
+	t.Helper()
+
+	log := logging.NewStdLogger(os.Stdout)
+
+	addrs := make([]raft.ServerAddress, n)
+	transports := make([]*raft.InmemTransport, n)
+	for i := 0; i < n; i++ {
+		addr, trans := raft.NewInmemTransport(raft.ServerAddress(fmt.Sprintf("node%d", i)))
+		addrs[i] = addr
+		transports[i] = trans
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i == j {
+				continue
+			}
+			transports[i].Connect(addrs[j], transports[j])
+		}
+	}
+
+	servers := make([]raft.Server, n)
+	for i := 0; i < n; i++ {
+		servers[i] = raft.Server{ID: raft.ServerID(addrs[i]), Address: addrs[i]}
+	}
+	cfg := raft.Configuration{Servers: servers}
+
+	nodes := make([]*testRaftNode, n)
+	for i := 0; i < n; i++ {
+		rdb := NewReplicatedDatabase(log, newFakeMemberDB())
+
+		raftCfg := raft.DefaultConfig()
+		raftCfg.LocalID = raft.ServerID(addrs[i])
+		raftCfg.HeartbeatTimeout = 50 * time.Millisecond
+		raftCfg.ElectionTimeout = 50 * time.Millisecond
+		raftCfg.LeaderLeaseTimeout = 50 * time.Millisecond
+		raftCfg.CommitTimeout = 5 * time.Millisecond
+
+		r, err := raft.NewRaft(raftCfg, rdb, raft.NewInmemStore(), raft.NewInmemStore(),
+			raft.NewInmemSnapshotStore(), transports[i])
+		if err != nil {
+			t.Fatalf("node %d: failed to start raft: %s", i, err)
+		}
+		rdb.SetRaft(r)
+
+		nodes[i] = &testRaftNode{rdb: rdb, raft: r}
+	}
+
+	nodes[0].raft.BootstrapCluster(cfg)
+
+	waitForLeader(t, nodes)
+
+	return nodes
+}
+
+// waitForLeader blocks until exactly one node in the cluster believes it is
+// the leader, failing the test if that doesn't happen in time.
+func waitForLeader(t *testing.T, nodes []*testRaftNode) *testRaftNode {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.raft.State() == raft.Leader {
+				return n
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("no leader elected before deadline")
+	return nil
+}
+
+func newTestMember(t *testing.T, rank Rank) *Member {
+	t.Helper()
+
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("127.0.0.1:%d", 10000+rank))
+	if err != nil {
+		t.Fatalf("failed to resolve test addr: %s", err)
+	}
+
+	return NewMember(rank, uuid.New().String(), "", addr, MemberStateJoined)
+}
+
+func TestReplicatedDatabase_ApplyAddUpdateRemove(t *testing.T) {
+	nodes := newTestRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	member := newTestMember(t, 1)
+	if err := leader.rdb.AddMember(member); err != nil {
+		t.Fatalf("AddMember failed: %s", err)
+	}
+
+	for _, n := range nodes {
+		got, err := n.rdb.FindMemberByUUID(member.UUID)
+		if err != nil {
+			t.Fatalf("member missing on replica: %s", err)
+		}
+		if got.State() != MemberStateJoined {
+			t.Fatalf("expected replicated state %s, got %s", MemberStateJoined, got.State())
+		}
+	}
+
+	member.Info = "updated"
+	if err := leader.rdb.UpdateMember(member); err != nil {
+		t.Fatalf("UpdateMember failed: %s", err)
+	}
+	for _, n := range nodes {
+		got, err := n.rdb.FindMemberByUUID(member.UUID)
+		if err != nil {
+			t.Fatalf("member missing on replica: %s", err)
+		}
+		if got.Info != "updated" {
+			t.Fatalf("update was not replicated to all nodes")
+		}
+	}
+
+	if err := leader.rdb.RemoveMember(member); err != nil {
+		t.Fatalf("RemoveMember failed: %s", err)
+	}
+	for _, n := range nodes {
+		if _, err := n.rdb.FindMemberByUUID(member.UUID); err == nil {
+			t.Fatalf("removal was not replicated to all nodes")
+		}
+	}
+}
+
+// TestReplicatedDatabase_RestoreReplacesLocalState exercises Restore on a
+// follower that already holds divergent membership, which is the normal
+// case Raft invokes Restore for (a lagging-but-not-empty follower), not
+// just a freshly bootstrapped, empty one.
+func TestReplicatedDatabase_RestoreReplacesLocalState(t *testing.T) {
+	log := logging.NewStdLogger(os.Stdout)
+
+	local := newFakeMemberDB()
+
+	stale := newTestMember(t, 1) // local only; absent from snapshot
+	if err := local.AddMember(stale); err != nil {
+		t.Fatalf("failed to seed stale member: %s", err)
+	}
+
+	shared := newTestMember(t, 2) // present in both, diverged locally
+	staleCopy := *shared
+	staleCopy.Info = "stale"
+	if err := local.AddMember(&staleCopy); err != nil {
+		t.Fatalf("failed to seed shared member: %s", err)
+	}
+
+	rd := NewReplicatedDatabase(log, local)
+
+	incoming := newTestMember(t, 3) // snapshot only; new to this follower
+	shared.Info = "fresh"
+	data, err := json.Marshal(Members{shared, incoming})
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %s", err)
+	}
+
+	if err := rd.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+
+	if _, err := rd.FindMemberByUUID(stale.UUID); err == nil {
+		t.Fatal("member absent from the snapshot should have been removed by Restore")
+	}
+
+	got, err := rd.FindMemberByUUID(shared.UUID)
+	if err != nil {
+		t.Fatalf("shared member missing after restore: %s", err)
+	}
+	if got.Info != "fresh" {
+		t.Fatalf("expected shared member to be updated to %q, got %q", "fresh", got.Info)
+	}
+
+	if _, err := rd.FindMemberByUUID(incoming.UUID); err != nil {
+		t.Fatalf("member only present in the snapshot missing after restore: %s", err)
+	}
+
+	if count := rd.MemberCount(); count != 2 {
+		t.Fatalf("expected local state to exactly match the 2-member snapshot, got %d members", count)
+	}
+}
+
+// TestMembership_JoinSurvivesLeaderFailure kills the leader mid-Join and
+// verifies that the joining member ends up in MemberStateJoined exactly
+// once, despite the failover and retry.
+func TestMembership_JoinSurvivesLeaderFailure(t *testing.T) {
+	nodes := newTestRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	ms := NewMembership(logging.NewStdLogger(os.Stdout), leader.rdb, 0, 0, 0)
+	defer ms.Stop()
+
+	member := newTestMember(t, 7)
+
+	// Force the apply to time out quickly so the leader failure below
+	// causes Join to return an error rather than hang.
+	leader.rdb.applyTimeout = 200 * time.Millisecond
+
+	joinErrCh := make(chan error, 1)
+	go func() {
+		_, err := ms.Join(member)
+		joinErrCh <- err
+	}()
+
+	// Give the Join a moment to reach raft.Apply, then kill the leader.
+	time.Sleep(10 * time.Millisecond)
+	if err := leader.raft.Shutdown().Error(); err != nil {
+		t.Fatalf("failed to shut down leader: %s", err)
+	}
+
+	if err := <-joinErrCh; err == nil {
+		t.Log("Join completed before leader shutdown took effect")
+	}
+
+	remaining := make([]*testRaftNode, 0, len(nodes)-1)
+	for _, n := range nodes {
+		if n != leader {
+			remaining = append(remaining, n)
+		}
+	}
+
+	newLeader := waitForLeader(t, remaining)
+	newMS := NewMembership(logging.NewStdLogger(os.Stdout), newLeader.rdb, 0, 0, 0)
+	defer newMS.Stop()
+
+	// Retry the Join against the new leader, as a real caller (backed by
+	// a client that re-resolves the leader) would.
+	if _, err := newMS.Join(member); err != nil {
+		t.Fatalf("retried Join failed: %s", err)
+	}
+
+	for _, n := range remaining {
+		got, err := n.rdb.FindMemberByUUID(member.UUID)
+		if err != nil {
+			t.Fatalf("member missing after failover: %s", err)
+		}
+		if got.State() != MemberStateJoined {
+			t.Fatalf("expected %s, got %s", MemberStateJoined, got.State())
+		}
+	}
+
+	// The member must have ended up Joined exactly once: there is only
+	// one member with this UUID in the surviving replicas' state, not a
+	// duplicate entry created by the retried Join.
+	matches := 0
+	for _, m := range remaining[0].rdb.AllMembers() {
+		if m.UUID == member.UUID {
+			matches++
+		}
+	}
+	if matches != 1 {
+		t.Fatalf("expected member to appear exactly once, found %d", matches)
+	}
+}